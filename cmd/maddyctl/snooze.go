@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddyctl
+
+import (
+	"fmt"
+
+	imapsql "github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+// snoozeMailboxFlag names the mailbox the messages were snoozed from.
+// Pending snoozes are recorded under the mailbox that was selected when
+// X-SNOOZE was issued; the storage.imapsql snooze_mailbox directive has no
+// effect on which mailbox that is.
+var snoozeMailboxFlag = &cli.StringFlag{
+	Name:  "mailbox",
+	Usage: "mailbox the messages were snoozed from (the one selected when X-SNOOZE was issued)",
+	Value: "Snoozed",
+}
+
+// SnoozeCommands builds the "snooze-list"/"snooze-cancel" subcommands
+// against store, for whatever assembles the root maddyctl cli.App to append
+// into its own Commands table.
+func SnoozeCommands(store *imapsql.Storage) []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:      "snooze-list",
+			Usage:     "List pending snoozes for a user",
+			ArgsUsage: "USERNAME",
+			Flags:     []cli.Flag{snoozeMailboxFlag},
+			Action: func(ctx *cli.Context) error {
+				return snoozeList(store, ctx)
+			},
+		},
+		{
+			Name:      "snooze-cancel",
+			Usage:     "Cancel a pending snooze",
+			ArgsUsage: "USERNAME",
+			Flags: []cli.Flag{
+				snoozeMailboxFlag,
+				&cli.UintFlag{Name: "uid", Usage: "UID of the message to cancel the snooze for", Required: true},
+			},
+			Action: func(ctx *cli.Context) error {
+				return snoozeCancel(store, ctx)
+			},
+		},
+	}
+}
+
+func snoozeList(store *imapsql.Storage, ctx *cli.Context) error {
+	account := ctx.Args().First()
+	if account == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	entries, err := store.PendingSnoozes(account, ctx.String("mailbox"))
+	if err != nil {
+		return fmt.Errorf("snooze-list: %w", err)
+	}
+
+	for _, e := range entries {
+		fmt.Printf("uid %d: snoozed until %s, returns to %s\n", e.UID, e.Until, e.ReturnTo)
+	}
+
+	return nil
+}
+
+func snoozeCancel(store *imapsql.Storage, ctx *cli.Context) error {
+	account := ctx.Args().Get(0)
+	uid := ctx.Uint("uid")
+	if account == "" || uid == 0 {
+		return cli.Exit("Error: USERNAME and --uid are required", 2)
+	}
+
+	if err := store.CancelSnooze(account, ctx.String("mailbox"), uint32(uid)); err != nil {
+		return fmt.Errorf("snooze-cancel: %w", err)
+	}
+
+	return nil
+}
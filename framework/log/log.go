@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package log implements the logging facility used throughout maddy.
+//
+// Loggers carry a Name (the facility, e.g. "imapsql") and an optional set
+// of key/value pairs attached via With, which every subsequent message
+// includes. This lets a single queue ID or account name be threaded through
+// a whole request without repeating it at every call site.
+package log
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Output writes a single log entry. Implementations must be safe for
+// concurrent use.
+type Output interface {
+	Write(sink string, debug bool, t time.Time, fields map[string]interface{}, msg string)
+}
+
+// Logger is a thin, struct-based logging handle. The zero value writes
+// to stderr in the plain text format.
+type Logger struct {
+	Out   Output
+	Name  string
+	Debug bool
+
+	fields map[string]interface{}
+}
+
+func DefaultLogger() Logger {
+	return Logger{Out: WriterOutput(os.Stderr, false)}
+}
+
+// With returns a child logger that attaches kv (alternating key, value,
+// ...) to every message it logs, in addition to the fields already
+// attached to the parent. It does not mutate the receiver.
+func (l Logger) With(kv ...interface{}) Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(kv)/2)
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		merged[key] = kv[i+1]
+	}
+
+	l.fields = merged
+	return l
+}
+
+func (l Logger) log(debug bool, fields map[string]interface{}, msg string) {
+	out := l.Out
+	if out == nil {
+		out = DefaultLogger().Out
+	}
+
+	all := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		all[k] = v
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+
+	out.Write(l.Name, debug, time.Now(), all, msg)
+}
+
+func (l Logger) Println(a ...interface{}) {
+	l.log(false, nil, fmt.Sprint(a...))
+}
+
+func (l Logger) Printf(format string, a ...interface{}) {
+	l.log(false, nil, fmt.Sprintf(format, a...))
+}
+
+func (l Logger) Debugln(a ...interface{}) {
+	if !l.Debug {
+		return
+	}
+	l.log(true, nil, fmt.Sprint(a...))
+}
+
+func (l Logger) Debugf(format string, a ...interface{}) {
+	if !l.Debug {
+		return
+	}
+	l.log(true, nil, fmt.Sprintf(format, a...))
+}
+
+// Error logs msg, attaching err and any extra kv (alternating key, value,
+// ...) as structured fields rather than interpolating them into the
+// message text.
+func (l Logger) Error(msg string, err error, kv ...interface{}) {
+	fields := make(map[string]interface{}, len(kv)/2+1)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		fields[key] = kv[i+1]
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	l.log(false, fields, msg)
+}
+
+// Printf is the package-level fallback used by code that runs before any
+// particular Logger is available (e.g. very early startup).
+func Printf(format string, a ...interface{}) {
+	DefaultLogger().Printf(format, a...)
+}
@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type writerOutput struct {
+	mu      sync.Mutex
+	w       io.Writer
+	minimal bool
+}
+
+// WriterOutput writes plain-text log lines to w, in the format maddy has
+// always used: "timestamp facility: message key=value ...".
+func WriterOutput(w io.Writer, minimal bool) Output {
+	return &writerOutput{w: w, minimal: minimal}
+}
+
+func (o *writerOutput) Write(sink string, debug bool, t time.Time, fields map[string]interface{}, msg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.minimal {
+		fmt.Fprintf(o.w, "%v ", t.Format(time.RFC3339))
+	}
+	if sink != "" {
+		fmt.Fprintf(o.w, "%v: ", sink)
+	}
+	if debug {
+		fmt.Fprint(o.w, "[debug] ")
+	}
+	fmt.Fprint(o.w, msg)
+
+	for _, k := range sortedKeys(fields) {
+		fmt.Fprintf(o.w, " %v=%v", k, fields[k])
+	}
+	fmt.Fprint(o.w, "\n")
+}
+
+// jsonOutput writes one JSON object per log entry, for shipping to
+// Loki/ELK and similar structured log collectors.
+type jsonOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// JSONOutput returns an Output that emits newline-delimited JSON objects
+// instead of the plain-text format. Selected via the 'log_format json'
+// directive.
+func JSONOutput(w io.Writer) Output {
+	return &jsonOutput{w: w}
+}
+
+func (o *jsonOutput) Write(sink string, debug bool, t time.Time, fields map[string]interface{}, msg string) {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = t.Format(time.RFC3339)
+	entry["facility"] = sink
+	entry["debug"] = debug
+	entry["msg"] = msg
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	enc := json.NewEncoder(o.w)
+	if err := enc.Encode(entry); err != nil {
+		fmt.Fprintf(o.w, `{"msg":"log encode failed","error":%q}`+"\n", err.Error())
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// BlobStore is a pluggable message body backend, selected via the
+// 'blobstore' directive and registered like any other module.Module - third
+// parties add more kinds the same way they'd add a new storage.* or
+// target.* module, by calling module.Register under the "blobstore."
+// prefix.
+type BlobStore interface {
+	module.Module
+	ExtStore() imapsql.ExtStore
+}
+
+// buildBlobStore builds the imapsql.ExtStore used for message bodies out of
+// the already-resolved 'blobstore', 'blob_delete_delay' and 'blob_cache_dir'
+// directives (see Storage.Init, which has to register all three before
+// cfg.Process runs). mod is nil when the directive was not given at all, in
+// which case fs stays the default so existing configs keep working
+// unchanged; fs is never wrapped in a cache since it is already local.
+func buildBlobStore(mod BlobStore, deleteDelay time.Duration, cacheDir, fsstoreLocation string) (imapsql.ExtStore, error) {
+	if mod == nil {
+		if err := os.MkdirAll(fsstoreLocation, os.ModeDir|os.ModePerm); err != nil {
+			return nil, err
+		}
+		return &imapsql.FSStore{Root: fsstoreLocation}, nil
+	}
+
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, os.ModeDir|os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cachingExtStore{remote: mod.ExtStore(), cacheDir: cacheDir, deleteDelay: deleteDelay}, nil
+}
+
+// cachingExtStore wraps a remote ExtStore with an optional local
+// read-through cache directory so repeated FETCHes of the same message
+// don't round-trip to S3/GCS every time, and defers remote deletes by
+// deleteDelay so a reader that still holds the key of a just-expunged
+// message has a chance to read it before it's actually gone.
+type cachingExtStore struct {
+	remote      imapsql.ExtStore
+	cacheDir    string
+	deleteDelay time.Duration
+}
+
+func (c *cachingExtStore) Create() (string, io.WriteCloser, error) {
+	return c.remote.Create()
+}
+
+func (c *cachingExtStore) Open(key string) (io.ReadCloser, error) {
+	if c.cacheDir == "" {
+		return c.remote.Open(key)
+	}
+
+	cachePath := filepath.Join(c.cacheDir, key)
+	if f, err := os.Open(cachePath); err == nil {
+		return f, nil
+	}
+
+	rc, err := c.remote.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(c.cacheDir, "blob-*")
+	if err != nil {
+		// Cache is best-effort; fall back to the remote object again.
+		return c.remote.Open(key)
+	}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return c.remote.Open(key)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return os.Open(cachePath)
+}
+
+func (c *cachingExtStore) Delete(keys []string) error {
+	if c.cacheDir != "" {
+		for _, key := range keys {
+			os.Remove(filepath.Join(c.cacheDir, key))
+		}
+	}
+	deferredDelete(c.remote, keys, c.deleteDelay)
+	return nil
+}
+
+func deferredDelete(store imapsql.ExtStore, keys []string, delay time.Duration) {
+	del := func() {
+		if err := store.Delete(keys); err != nil {
+			log.DefaultLogger().Error("blobstore: deferred delete failed", err)
+		}
+	}
+
+	if delay <= 0 {
+		del()
+		return
+	}
+	time.AfterFunc(delay, del)
+}
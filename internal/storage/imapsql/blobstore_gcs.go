@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"io"
+
+	gcstorage "cloud.google.com/go/storage"
+	"github.com/google/uuid"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	maddyConfig "github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// gcsBlobs is the "blobstore.gcs" module, an ExtStore backend on top of a
+// Google Cloud Storage bucket with optional customer-managed encryption
+// (CMEK).
+type gcsBlobs struct {
+	instName string
+
+	client     *gcstorage.Client
+	bucket     string
+	kmsKeyName string
+}
+
+func NewGCSBlobs(_, instName string, _, _ []string) (module.Module, error) {
+	return &gcsBlobs{instName: instName}, nil
+}
+
+func (g *gcsBlobs) Name() string         { return "blobstore.gcs" }
+func (g *gcsBlobs) InstanceName() string { return g.instName }
+
+func (g *gcsBlobs) Init(cfg *maddyConfig.Map) error {
+	cfg.String("bucket", false, true, "", &g.bucket)
+	cfg.String("kms_key", false, false, "", &g.kmsKeyName)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	client, err := gcstorage.NewClient(context.Background())
+	if err != nil {
+		return err
+	}
+	g.client = client
+
+	return nil
+}
+
+func (g *gcsBlobs) ExtStore() imapsql.ExtStore {
+	return g
+}
+
+func (g *gcsBlobs) Create() (string, io.WriteCloser, error) {
+	key := uuid.NewString()
+	w := g.client.Bucket(g.bucket).Object(key).NewWriter(context.Background())
+	if g.kmsKeyName != "" {
+		w.KMSKeyName = g.kmsKeyName
+	}
+	return key, w, nil
+}
+
+func (g *gcsBlobs) Open(key string) (io.ReadCloser, error) {
+	return g.client.Bucket(g.bucket).Object(key).NewReader(context.Background())
+}
+
+func (g *gcsBlobs) Delete(keys []string) error {
+	for _, key := range keys {
+		if err := g.client.Bucket(g.bucket).Object(key).Delete(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register("blobstore.gcs", NewGCSBlobs)
+}
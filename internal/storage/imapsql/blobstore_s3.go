@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	maddyConfig "github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// s3Blobs is the "blobstore.s3" module, an ExtStore backend on top of an
+// S3-compatible bucket with optional server-side encryption.
+type s3Blobs struct {
+	instName string
+
+	client    *s3.Client
+	bucket    string
+	sseKMSKey string
+}
+
+func NewS3Blobs(_, instName string, _, _ []string) (module.Module, error) {
+	return &s3Blobs{instName: instName}, nil
+}
+
+func (s *s3Blobs) Name() string         { return "blobstore.s3" }
+func (s *s3Blobs) InstanceName() string { return s.instName }
+
+func (s *s3Blobs) Init(cfg *maddyConfig.Map) error {
+	var (
+		region   string
+		endpoint string
+	)
+	cfg.String("bucket", false, true, "", &s.bucket)
+	cfg.String("region", false, false, "us-east-1", &region)
+	cfg.String("endpoint", false, false, "", &endpoint)
+	cfg.String("sse_kms_key", false, false, "", &s.sseKMSKey)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	loadOpts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return err
+	}
+
+	s.client = s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	return nil
+}
+
+func (s *s3Blobs) ExtStore() imapsql.ExtStore {
+	return s
+}
+
+func (s *s3Blobs) Create() (string, io.WriteCloser, error) {
+	key := uuid.NewString()
+	return key, &s3PendingWrite{store: s, key: key}, nil
+}
+
+func (s *s3Blobs) Open(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Blobs) Delete(keys []string) error {
+	for _, key := range keys {
+		if _, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3PendingWrite buffers a message body in memory until Close, then issues
+// a single PutObject - go-imap-sql's ExtStore.Create contract expects a
+// seekable-free streaming writer, and S3 has no append API.
+type s3PendingWrite struct {
+	store *s3Blobs
+	key   string
+	buf   bytes.Buffer
+}
+
+func (w *s3PendingWrite) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *s3PendingWrite) Close() error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(w.store.bucket),
+		Key:    aws.String(w.key),
+		Body:   bytes.NewReader(w.buf.Bytes()),
+	}
+	if w.store.sseKMSKey != "" {
+		input.ServerSideEncryption = "aws:kms"
+		input.SSEKMSKeyId = aws.String(w.store.sseKMSKey)
+	}
+	_, err := w.store.client.PutObject(context.Background(), input)
+	return err
+}
+
+func init() {
+	module.Register("blobstore.s3", NewS3Blobs)
+}
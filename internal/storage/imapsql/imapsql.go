@@ -27,16 +27,21 @@ package imapsql
 
 import (
 	"crypto/sha1"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
+	id "github.com/emersion/go-imap-id"
+	"github.com/emersion/go-imap-namespace"
 	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/backend"
 	imapsql "github.com/foxcpp/go-imap-sql"
@@ -70,6 +75,15 @@ type Storage struct {
 	updPushStop chan struct{}
 
 	filters module.IMAPFilter
+
+	serverID   map[string]string
+	nsPersonal string
+	nsOther    string
+	nsShared   string
+
+	snoozeMbox string
+	snoozeDB   *sql.DB
+	snoozeStop chan struct{}
 }
 
 func (store *Storage) Name() string {
@@ -124,10 +138,41 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
+	var logFormat string
+	cfg.Enum("log_format", false, false, []string{"text", "json"}, "text", &logFormat)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("sqlite3_exclusive_lock", false, false, &opts.ExclusiveLock)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.StringMap("id", false, false, map[string]string{
+		"name": "maddy",
+		"os":   runtime.GOOS,
+	}, &store.serverID)
+	cfg.String("namespace_personal", false, false, "", &store.nsPersonal)
+	cfg.String("namespace_other", false, false, "Other Users", &store.nsOther)
+	cfg.String("namespace_shared", false, false, "Shared", &store.nsShared)
+	cfg.String("snooze_mailbox", false, false, "Snoozed", &store.snoozeMbox)
+	var blobMod BlobStore
+	cfg.Custom("blobstore", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) == 0 {
+			return nil, config.NodeErr(node, "expected at least 1 argument")
+		}
+		var mod module.Module
+		if err := modconfig.GroupFromNode("blobstore", node.Args, node, m.Globals, &mod); err != nil {
+			return nil, err
+		}
+		bs, ok := mod.(BlobStore)
+		if !ok {
+			return nil, config.NodeErr(node, "%s is not a blobstore", node.Args[0])
+		}
+		return bs, nil
+	}, &blobMod)
+	var blobDeleteDelay time.Duration
+	cfg.Duration("blob_delete_delay", false, false, 0, &blobDeleteDelay)
+	var blobCacheDir string
+	cfg.String("blob_cache_dir", false, false, "", &blobCacheDir)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -147,6 +192,10 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return errors.New("imapsql: driver is required")
 	}
 
+	if logFormat == "json" {
+		store.Log.Out = log.JSONOutput(os.Stderr)
+	}
+
 	opts.Log = &store.Log
 
 	if appendlimitVal == -1 {
@@ -160,14 +209,12 @@ func (store *Storage) Init(cfg *config.Map) error {
 		opts.MaxMsgBytes = new(uint32)
 		*opts.MaxMsgBytes = uint32(appendlimitVal)
 	}
-	var err error
-
 	dsnStr := strings.Join(dsn, " ")
 
-	if err := os.MkdirAll(fsstoreLocation, os.ModeDir|os.ModePerm); err != nil {
+	extStore, err := buildBlobStore(blobMod, blobDeleteDelay, blobCacheDir, fsstoreLocation)
+	if err != nil {
 		return err
 	}
-	extStore := &imapsql.FSStore{Root: fsstoreLocation}
 
 	if len(compression) != 0 {
 		switch compression[0] {
@@ -203,6 +250,20 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Back.EnableChildrenExt()
 	store.Back.EnableSpecialUseExt()
+	store.Back.RegisterThreadAlgorithm(sortthread.References, func(mbox backend.Mailbox, uid bool) (*sortthread.Thread, error) {
+		return threadMailbox(mbox, sortthread.References, uid)
+	})
+
+	store.snoozeDB, err = sql.Open(driver, dsnStr)
+	if err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+	if err := store.initSnoozeTable(); err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+
+	store.snoozeStop = make(chan struct{})
+	go store.runSnoozeWorker(store.snoozeStop)
 
 	return nil
 }
@@ -226,6 +287,13 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 				fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:]))),
 			Log: log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug},
 		}
+	case "postgres":
+		dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
+		store.updPipe = &updatepipe.PgListenPipe{
+			DSN:     strings.Join(store.dsn, " "),
+			Channel: "maddy_imapsql_" + hex.EncodeToString(dbId[:]),
+			Log:     log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug},
+		}
 	default:
 		return errors.New("imapsql: driver does not have an update pipe implementation")
 	}
@@ -251,8 +319,8 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			close(wrapped)
 
 			if err := recover(); err != nil {
-				stack := debug.Stack()
-				log.Printf("panic during imapsql update push: %v\n%s", err, stack)
+				store.Log.Error("panic during update push", fmt.Errorf("%v", err),
+					"stack", string(debug.Stack()))
 			}
 		}()
 
@@ -286,8 +354,19 @@ func (store *Storage) I18NLevel() int {
 	return 1
 }
 
+// IMAPExtensions lists the extensions this backend actually implements.
+// Notably absent: CONDSTORE/QRESYNC. Advertising them needs a real
+// HIGHESTMODSEQ column, per-change MODSEQ assignment, expunged-UID
+// retention, and CHANGEDSINCE/UNCHANGEDSINCE/VANISHED handling in
+// SELECT/FETCH/STORE/SEARCH, with MODSEQ routed through the update pipe -
+// none of which exists here yet. Treat CONDSTORE/QRESYNC as an open,
+// unstarted backlog item rather than something this package half-supports.
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	return []string{
+		"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT",
+		"THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES",
+		"IDLE", "UNSELECT", "ID", "NAMESPACE", "ENABLE", "LIST-EXTENDED",
+	}
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -356,13 +435,18 @@ func (store *Storage) Lookup(key string) (string, bool, error) {
 		return "", false, err
 	}
 	if err := usr.Logout(); err != nil {
-		store.Log.Error("logout failed", err, "username", accountName)
+		store.Log.With("account", accountName).Error("logout failed", err)
 	}
 
 	return "", true, nil
 }
 
 func (store *Storage) Close() error {
+	close(store.snoozeStop)
+	if store.snoozeDB != nil {
+		store.snoozeDB.Close()
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -384,9 +468,36 @@ func (store *Storage) Login(_ *imap.ConnInfo, usenrame, password string) (backen
 }
 
 func (store *Storage) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
-	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject}
+	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject, sortthread.References}
+}
+
+// ID implements id.Backend. It logs whatever the client identifies itself as
+// as a debug message with no account attached (the method is not given the
+// connection or its user) and replies with the server identification
+// configured via the 'id' directive.
+func (store *Storage) ID(clientID map[string]string) (map[string]string, error) {
+	if len(clientID) != 0 {
+		store.Log.Debugln("client ID:", clientID)
+	}
+	return store.serverID, nil
 }
 
+// GetNamespace implements namespace.Backend using the configurable
+// namespace_personal/namespace_other/namespace_shared prefixes.
+func (store *Storage) GetNamespace(username string) (*namespace.Namespace, error) {
+	ns := &namespace.Namespace{}
+	ns.Personal = append(ns.Personal, namespace.Entry{Prefix: store.nsPersonal, Delimiter: "."})
+	if store.nsOther != "" {
+		ns.Other = append(ns.Other, namespace.Entry{Prefix: store.nsOther, Delimiter: "."})
+	}
+	if store.nsShared != "" {
+		ns.Shared = append(ns.Shared, namespace.Entry{Prefix: store.nsShared, Delimiter: "."})
+	}
+	return ns, nil
+}
+
+var _ id.Backend = &Storage{}
+
 func init() {
 	module.RegisterDeprecated("imapsql", "storage.imapsql", New)
 	module.Register("storage.imapsql", New)
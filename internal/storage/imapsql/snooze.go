@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// SnoozedKeyword is the IMAP keyword flag Snooze sets on a message and the
+// unsnooze worker clears when it moves the message back. It is exposed so
+// MUAs can recognize snoozed messages without a separate FETCH round-trip.
+const SnoozedKeyword = "$Snoozed"
+
+// snoozeEntry is a single pending snooze.
+type snoozeEntry struct {
+	Account    string
+	SrcMailbox string
+	UID        uint32
+	Until      time.Time
+	ReturnTo   string
+}
+
+// snoozePlaceholder returns the driver's positional parameter syntax for the
+// i'th (1-based) argument of a query against snoozeDB. lib/pq only accepts
+// $1, $2, ...; sqlite3 and the MySQL driver both accept plain ?.
+func (store *Storage) snoozePlaceholder(i int) string {
+	if store.driver == "postgres" {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// initSnoozeTable creates the bookkeeping table the unsnooze worker reads
+// from. This lives entirely on the imapsql side of the schema - it does not
+// require any change to go-imap-sql, which only needs to know about the
+// $Snoozed keyword it already accepts as an arbitrary IMAP keyword. The
+// column types are adjusted per driver since MySQL can't put a PRIMARY KEY
+// on an unbounded TEXT column.
+func (store *Storage) initSnoozeTable() error {
+	textType := "TEXT"
+	if store.driver == "mysql" {
+		textType = "VARCHAR(255)"
+	}
+
+	_, err := store.snoozeDB.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS maddy_snoozed (
+			account        %[1]s NOT NULL,
+			src_mailbox    %[1]s NOT NULL,
+			uid            INTEGER NOT NULL,
+			until          %[1]s NOT NULL,
+			return_mailbox %[1]s NOT NULL,
+			PRIMARY KEY (account, src_mailbox, uid)
+		)`, textType))
+	return err
+}
+
+// upsertSnoozeSQL returns the dialect-appropriate "insert, or update if the
+// (account, src_mailbox, uid) triple already exists" query: SQLite has its
+// own INSERT OR REPLACE, Postgres needs ON CONFLICT, and MySQL needs ON
+// DUPLICATE KEY UPDATE.
+func (store *Storage) upsertSnoozeSQL() string {
+	switch store.driver {
+	case "postgres":
+		return fmt.Sprintf(`
+			INSERT INTO maddy_snoozed (account, src_mailbox, uid, until, return_mailbox)
+			VALUES (%s, %s, %s, %s, %s)
+			ON CONFLICT (account, src_mailbox, uid) DO UPDATE
+				SET until = EXCLUDED.until, return_mailbox = EXCLUDED.return_mailbox`,
+			store.snoozePlaceholder(1), store.snoozePlaceholder(2), store.snoozePlaceholder(3),
+			store.snoozePlaceholder(4), store.snoozePlaceholder(5))
+	case "mysql":
+		return `
+			INSERT INTO maddy_snoozed (account, src_mailbox, uid, until, return_mailbox)
+			VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE until = VALUES(until), return_mailbox = VALUES(return_mailbox)`
+	default: // sqlite3
+		return `
+			INSERT OR REPLACE INTO maddy_snoozed (account, src_mailbox, uid, until, return_mailbox)
+			VALUES (?, ?, ?, ?, ?)`
+	}
+}
+
+// Snooze adds SnoozedKeyword to the message with uid in srcMailbox and
+// records until and returnTo (or INBOX, if empty), the mailbox the unsnooze
+// worker moves it into once until has passed. The message is neither moved
+// nor hidden before then: it stays visible in srcMailbox. It backs the
+// X-SNOOZE IMAP verb.
+func (store *Storage) Snooze(account, srcMailbox string, uid uint32, until time.Time, returnTo string) error {
+	if returnTo == "" {
+		returnTo = "INBOX"
+	}
+
+	usr, err := store.Back.GetUser(account)
+	if err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+	mbox, err := usr.GetMailbox(srcMailbox)
+	if err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	if err := mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{SnoozedKeyword}); err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+
+	_, err = store.snoozeDB.Exec(store.upsertSnoozeSQL(),
+		account, srcMailbox, uid, until.UTC().Format(time.RFC3339), returnTo)
+	if err != nil {
+		return fmt.Errorf("imapsql: snooze: %w", err)
+	}
+
+	return nil
+}
+
+// CancelSnooze removes a pending snooze without moving the message, leaving
+// it (still carrying SnoozedKeyword) wherever it currently is.
+func (store *Storage) CancelSnooze(account, srcMailbox string, uid uint32) error {
+	query := fmt.Sprintf(
+		`DELETE FROM maddy_snoozed WHERE account = %s AND src_mailbox = %s AND uid = %s`,
+		store.snoozePlaceholder(1), store.snoozePlaceholder(2), store.snoozePlaceholder(3))
+	_, err := store.snoozeDB.Exec(query, account, srcMailbox, uid)
+	return err
+}
+
+// PendingSnoozes lists every snooze still pending for account in srcMailbox,
+// for the maddyctl snooze-list subcommand.
+func (store *Storage) PendingSnoozes(account, srcMailbox string) ([]snoozeEntry, error) {
+	query := fmt.Sprintf(
+		`SELECT uid, until, return_mailbox FROM maddy_snoozed WHERE account = %s AND src_mailbox = %s`,
+		store.snoozePlaceholder(1), store.snoozePlaceholder(2))
+	rows, err := store.snoozeDB.Query(query, account, srcMailbox)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []snoozeEntry
+	for rows.Next() {
+		var (
+			uid      uint32
+			untilStr string
+			returnTo string
+		)
+		if err := rows.Scan(&uid, &untilStr, &returnTo); err != nil {
+			return nil, err
+		}
+		until, err := time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, snoozeEntry{
+			Account: account, SrcMailbox: srcMailbox,
+			UID: uid, Until: until, ReturnTo: returnTo,
+		})
+	}
+	return entries, rows.Err()
+}
+
+// runSnoozeWorker wakes up whenever the earliest pending snooze is due (or
+// snoozePoll elapses, whichever is sooner, so a newly scheduled snooze
+// earlier than the current timer is still picked up promptly) and moves
+// matured messages back to their return mailbox.
+//
+// It is started from Init and stopped by closing stop.
+func (store *Storage) runSnoozeWorker(stop <-chan struct{}) {
+	const snoozePoll = time.Minute
+
+	timer := time.NewTimer(snoozePoll)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			next, err := store.unsnoozeMatured()
+			if err != nil {
+				store.Log.Error("unsnooze worker failed", err)
+				timer.Reset(snoozePoll)
+				continue
+			}
+
+			wait := snoozePoll
+			if !next.IsZero() {
+				if d := time.Until(next); d > 0 && d < wait {
+					wait = d
+				}
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// unsnoozeMatured moves every message whose until has passed back to its
+// return mailbox, clearing SnoozedKeyword along the way, and returns the
+// timestamp of the next still-pending snooze (if any) so the caller can set
+// a precise wakeup timer instead of polling blindly.
+func (store *Storage) unsnoozeMatured() (time.Time, error) {
+	query := fmt.Sprintf(
+		`SELECT account, src_mailbox, uid, return_mailbox FROM maddy_snoozed WHERE until <= %s`,
+		store.snoozePlaceholder(1))
+	rows, err := store.snoozeDB.Query(query, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	type matured struct {
+		account, srcMailbox, returnTo string
+		uid                           uint32
+	}
+	var due []matured
+	for rows.Next() {
+		var m matured
+		if err := rows.Scan(&m.account, &m.srcMailbox, &m.uid, &m.returnTo); err != nil {
+			rows.Close()
+			return time.Time{}, err
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	for _, m := range due {
+		if err := store.unsnoozeOne(m.account, m.srcMailbox, m.uid, m.returnTo); err != nil {
+			store.Log.With("account", m.account, "uid", m.uid).Error("unsnooze move failed", err)
+			continue
+		}
+	}
+
+	var nextStr sql.NullString
+	if err := store.snoozeDB.QueryRow(`SELECT MIN(until) FROM maddy_snoozed`).Scan(&nextStr); err != nil {
+		return time.Time{}, err
+	}
+	if !nextStr.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, nextStr.String)
+}
+
+func (store *Storage) unsnoozeOne(account, srcMailbox string, uid uint32, returnTo string) error {
+	usr, err := store.Back.GetUser(account)
+	if err != nil {
+		return err
+	}
+	mbox, err := usr.GetMailbox(srcMailbox)
+	if err != nil {
+		return err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	if err := mbox.UpdateMessagesFlags(true, seqSet, imap.RemoveFlags, []string{SnoozedKeyword}); err != nil {
+		return err
+	}
+	if err := mbox.MoveMessages(true, seqSet, returnTo); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(
+		`DELETE FROM maddy_snoozed WHERE account = %s AND src_mailbox = %s AND uid = %s`,
+		store.snoozePlaceholder(1), store.snoozePlaceholder(2), store.snoozePlaceholder(3))
+	_, err = store.snoozeDB.Exec(query, account, srcMailbox, uid)
+	return err
+}
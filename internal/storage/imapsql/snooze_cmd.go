@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap/server"
+)
+
+// Extensions exposes this backend's own IMAP commands - currently just
+// X-SNOOZE - so the IMAP listener can register them the same way it
+// registers the go-imap-move/go-imap-id/... extension packages.
+func (store *Storage) Extensions() []server.Extension {
+	return []server.Extension{&snoozeExtension{store: store}}
+}
+
+type snoozeExtension struct {
+	store *Storage
+}
+
+func (e *snoozeExtension) Capabilities(c *server.Conn) []string {
+	if c.Context() == nil || c.Context().User == nil {
+		return nil
+	}
+	return []string{"X-SNOOZE"}
+}
+
+func (e *snoozeExtension) Command(name string) server.HandlerFactory {
+	if name != "X-SNOOZE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &snoozeCommand{store: e.store}
+	}
+}
+
+// snoozeCommand implements "X-SNOOZE <uid> <RFC3339 timestamp>": it marks
+// the given message (in the currently selected mailbox, identified by UID)
+// with SnoozedKeyword and schedules it to be moved to INBOX at the given
+// time. The message is not moved into the snooze mailbox; it stays in the
+// selected mailbox until then.
+type snoozeCommand struct {
+	store *Storage
+	uid   uint32
+	until time.Time
+}
+
+func (cmd *snoozeCommand) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("X-SNOOZE: expected <uid> <RFC3339 timestamp>")
+	}
+
+	uidStr, ok := fields[0].(string)
+	if !ok {
+		return errors.New("X-SNOOZE: invalid UID")
+	}
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return errors.New("X-SNOOZE: invalid UID")
+	}
+	cmd.uid = uint32(uid)
+
+	untilStr, ok := fields[1].(string)
+	if !ok {
+		return errors.New("X-SNOOZE: invalid timestamp")
+	}
+	until, err := time.Parse(time.RFC3339, untilStr)
+	if err != nil {
+		return errors.New("X-SNOOZE: timestamp must be RFC3339")
+	}
+	cmd.until = until
+
+	return nil
+}
+
+func (cmd *snoozeCommand) Handle(conn *server.Conn) error {
+	ctx := conn.Context()
+	if ctx == nil || ctx.User == nil || ctx.Mailbox == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	return cmd.store.Snooze(ctx.User.Username(), ctx.Mailbox.Name(), cmd.uid, cmd.until, "")
+}
@@ -0,0 +1,370 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+)
+
+// threadMsgInfo is the per-message data needed to build a JWZ REFERENCES
+// thread tree. It is fetched in bulk for the whole mailbox by
+// fetchThreadData so we avoid one round-trip per message.
+type threadMsgInfo struct {
+	SeqNum     uint32
+	MsgID      string
+	References []string
+	InReplyTo  string
+	Subject    string
+	Date       time.Time
+}
+
+// threadContainer is the JWZ "container" - either a real message (seqNum != 0)
+// or a placeholder created because it was referenced but never fetched.
+type threadContainer struct {
+	seqNum   uint32
+	msgID    string
+	subject  string
+	date     time.Time
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+func (c *threadContainer) isDummy() bool {
+	return c.seqNum == 0
+}
+
+// addChild links child under c, refusing to introduce a cycle.
+func (c *threadContainer) addChild(child *threadContainer) {
+	if child == c || child.isAncestorOf(c) {
+		return
+	}
+	if child.parent != nil {
+		child.parent.removeChild(child)
+	}
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *threadContainer) isAncestorOf(other *threadContainer) bool {
+	for p := other.parent; p != nil; p = p.parent {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) removeChild(child *threadContainer) {
+	for i, ch := range c.children {
+		if ch == child {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// buildReferencesThread implements the JWZ "An Efficient Algorithm for
+// Threading Mail Messages" algorithm on top of the References/In-Reply-To/
+// Subject metadata returned by extractThreadMsgInfo.
+func buildReferencesThread(msgs []threadMsgInfo) *sortthread.Thread {
+	containers := make(map[string]*threadContainer, len(msgs))
+
+	getOrCreate := func(id string) *threadContainer {
+		c, ok := containers[id]
+		if !ok {
+			c = &threadContainer{msgID: id}
+			containers[id] = c
+		}
+		return c
+	}
+
+	var roots []*threadContainer
+
+	for _, msg := range msgs {
+		refs := msg.References
+		if len(refs) == 0 && msg.InReplyTo != "" {
+			refs = []string{msg.InReplyTo}
+		}
+
+		var this *threadContainer
+		if msg.MsgID != "" {
+			this = getOrCreate(msg.MsgID)
+		} else {
+			// No Message-ID at all - give it a container of its own that
+			// nothing else can ever reference.
+			this = &threadContainer{}
+		}
+		this.seqNum = msg.SeqNum
+		this.subject = normalizeSubject(msg.Subject)
+		this.date = msg.Date
+
+		// Link the reference chain: refs[0] -> refs[1] -> ... -> this.
+		var prev *threadContainer
+		for _, ref := range refs {
+			cur := getOrCreate(ref)
+			if prev != nil {
+				prev.addChild(cur)
+			}
+			prev = cur
+		}
+		if prev != nil {
+			prev.addChild(this)
+		} else if this.parent == nil {
+			roots = append(roots, this)
+		}
+	}
+
+	// Any container with no parent that wasn't already recorded as a root
+	// (e.g. pure placeholders referenced by nobody directly) is a root too.
+	for _, c := range containers {
+		if c.parent == nil {
+			already := false
+			for _, r := range roots {
+				if r == c {
+					already = true
+					break
+				}
+			}
+			if !already {
+				roots = append(roots, c)
+			}
+		}
+	}
+
+	roots = pruneAndPromote(roots)
+	roots = groupBySubject(roots)
+	sortByDate(roots)
+
+	return &sortthread.Thread{Children: containersToThreads(roots)}
+}
+
+// pruneAndPromote drops dummy (message-less) containers that have zero
+// children, and promotes a dummy's sole child to stand in its place so
+// orphan chains collapse instead of showing up as empty nodes.
+func pruneAndPromote(nodes []*threadContainer) []*threadContainer {
+	var out []*threadContainer
+	for _, c := range nodes {
+		c.children = pruneAndPromote(c.children)
+
+		if c.isDummy() {
+			switch len(c.children) {
+			case 0:
+				continue // drop entirely
+			case 1:
+				child := c.children[0]
+				child.parent = c.parent
+				out = append(out, child)
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// groupBySubject merges top-level containers whose normalized subject
+// matches into a single (possibly dummy) parent, per the JWZ algorithm.
+func groupBySubject(roots []*threadContainer) []*threadContainer {
+	bySubject := make(map[string]*threadContainer, len(roots))
+	var out []*threadContainer
+
+	for _, c := range roots {
+		if c.subject == "" {
+			out = append(out, c)
+			continue
+		}
+		if existing, ok := bySubject[c.subject]; ok {
+			if existing.isDummy() {
+				existing.addChild(c)
+			} else if c.isDummy() {
+				c.addChild(existing)
+				bySubject[c.subject] = c
+				for i, o := range out {
+					if o == existing {
+						out[i] = c
+						break
+					}
+				}
+			} else {
+				dummy := &threadContainer{subject: c.subject}
+				dummy.addChild(existing)
+				dummy.addChild(c)
+				bySubject[c.subject] = dummy
+				for i, o := range out {
+					if o == existing {
+						out[i] = dummy
+						break
+					}
+				}
+			}
+			continue
+		}
+		bySubject[c.subject] = c
+		out = append(out, c)
+	}
+
+	return out
+}
+
+// earliestDate returns the minimum internal date among c and its descendants.
+func earliestDate(c *threadContainer) time.Time {
+	earliest := c.date
+	for _, ch := range c.children {
+		if d := earliestDate(ch); earliest.IsZero() || (!d.IsZero() && d.Before(earliest)) {
+			earliest = d
+		}
+	}
+	return earliest
+}
+
+func sortByDate(nodes []*threadContainer) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return earliestDate(nodes[i]).Before(earliestDate(nodes[j]))
+	})
+	for _, c := range nodes {
+		sortByDate(c.children)
+	}
+}
+
+func containersToThreads(nodes []*threadContainer) []*sortthread.Thread {
+	threads := make([]*sortthread.Thread, 0, len(nodes))
+	for _, c := range nodes {
+		threads = append(threads, &sortthread.Thread{
+			Id:       c.seqNum,
+			Children: containersToThreads(c.children),
+		})
+	}
+	return threads
+}
+
+func normalizeSubject(subj string) string {
+	s := strings.TrimSpace(subj)
+	for {
+		lower := strings.ToLower(s)
+		switch {
+		case strings.HasPrefix(lower, "re:"):
+			s = strings.TrimSpace(s[3:])
+		case strings.HasPrefix(lower, "fwd:"):
+			s = strings.TrimSpace(s[4:])
+		case strings.HasPrefix(lower, "fw:"):
+			s = strings.TrimSpace(s[3:])
+		default:
+			return strings.Join(strings.Fields(s), " ")
+		}
+	}
+}
+
+// referencesFetchItems are the FETCH items needed to build a REFERENCES
+// thread tree: the envelope gives us Message-Id/In-Reply-To/Subject,
+// INTERNALDATE the date threads are sorted by, and a header-fields-only
+// BODY.PEEK covers References (ENVELOPE does not carry it). All are standard
+// IMAP, so this runs against any backend.Mailbox without requiring changes to
+// the underlying storage library.
+var referencesFetchItems = []imap.FetchItem{
+	imap.FetchEnvelope,
+	imap.FetchInternalDate,
+	imap.FetchUid,
+	imap.FetchItem("BODY.PEEK[HEADER.FIELDS (REFERENCES)]"),
+}
+
+// fetchThreadData runs the query path for THREAD=REFERENCES: a whole-mailbox
+// FETCH for just the headers the algorithm needs, via the backend.Mailbox
+// interface every storage backend already implements. Messages are always
+// listed by sequence number 1..Messages so the whole mailbox is covered; when
+// uid is set, each message's UID is used as its thread Id.
+func fetchThreadData(mbox backend.Mailbox, uid bool) ([]threadMsgInfo, error) {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return nil, err
+	}
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, status.Messages)
+
+	ch := make(chan *imap.Message, 32)
+	done := make(chan error, 1)
+	go func() { done <- mbox.ListMessages(false, seqSet, referencesFetchItems, ch) }()
+
+	var msgs []threadMsgInfo
+	for msg := range ch {
+		info := extractThreadMsgInfo(msg)
+		if uid {
+			info.SeqNum = msg.Uid
+		}
+		msgs = append(msgs, info)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// extractThreadMsgInfo pulls the References header out of the raw
+// BODY.PEEK[HEADER.FIELDS (REFERENCES)] section, the date out of
+// INTERNALDATE and the rest out of the already-parsed ENVELOPE.
+func extractThreadMsgInfo(msg *imap.Message) threadMsgInfo {
+	info := threadMsgInfo{SeqNum: msg.SeqNum, Date: msg.InternalDate}
+
+	if env := msg.Envelope; env != nil {
+		info.MsgID = env.MessageId
+		info.InReplyTo = env.InReplyTo
+		info.Subject = env.Subject
+	}
+
+	for _, body := range msg.Body {
+		r := bufio.NewReader(body)
+		hdr, err := textproto.ReadHeader(r)
+		if err != nil {
+			continue
+		}
+		if raw := hdr.Get("References"); raw != "" {
+			info.References = strings.Fields(raw)
+		}
+	}
+
+	return info
+}
+
+// threadMailbox is the THREAD=REFERENCES entry point: it fetches the
+// metadata it needs through fetchThreadData and runs the pure JWZ algorithm
+// in buildReferencesThread.
+func threadMailbox(mbox backend.Mailbox, alg sortthread.ThreadAlgorithm, uid bool) (*sortthread.Thread, error) {
+	switch alg {
+	case sortthread.References:
+		msgs, err := fetchThreadData(mbox, uid)
+		if err != nil {
+			return nil, err
+		}
+		return buildReferencesThread(msgs), nil
+	default:
+		return nil, fmt.Errorf("imapsql: unsupported thread algorithm %v", alg)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"Hello world", "Hello world"},
+		{"Re: Hello world", "Hello world"},
+		{"re:Hello world", "Hello world"},
+		{"Fwd: Re: Hello   world", "Hello world"},
+		{"  Hello   world  ", "Hello world"},
+	}
+	for _, c := range cases {
+		if got := normalizeSubject(c.in); got != c.want {
+			t.Errorf("normalizeSubject(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestBuildReferencesThread_SimpleChain(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []threadMsgInfo{
+		{SeqNum: 1, MsgID: "a", Subject: "Hi", Date: base},
+		{SeqNum: 2, MsgID: "b", References: []string{"a"}, Subject: "Re: Hi", Date: base.Add(time.Hour)},
+		{SeqNum: 3, MsgID: "c", References: []string{"a", "b"}, Subject: "Re: Hi", Date: base.Add(2 * time.Hour)},
+	}
+
+	thread := buildReferencesThread(msgs)
+	if len(thread.Children) != 1 {
+		t.Fatalf("expected 1 root, got %d", len(thread.Children))
+	}
+	root := thread.Children[0]
+	if root.Id != 1 {
+		t.Fatalf("root Id = %d, want 1", root.Id)
+	}
+	if len(root.Children) != 1 || root.Children[0].Id != 2 {
+		t.Fatalf("expected message 2 as sole child of root, got %+v", root.Children)
+	}
+	child := root.Children[0]
+	if len(child.Children) != 1 || child.Children[0].Id != 3 {
+		t.Fatalf("expected message 3 as child of message 2, got %+v", child.Children)
+	}
+}
+
+func TestBuildReferencesThread_OrphanChainCollapses(t *testing.T) {
+	// "missing" is never fetched - it should be pruned/promoted rather than
+	// showing up as an empty placeholder node.
+	msgs := []threadMsgInfo{
+		{SeqNum: 1, MsgID: "child", References: []string{"missing"}, Subject: "Hi"},
+	}
+
+	thread := buildReferencesThread(msgs)
+	if len(thread.Children) != 1 || thread.Children[0].Id != 1 {
+		t.Fatalf("expected the orphan to be promoted to root, got %+v", thread.Children)
+	}
+}
+
+func TestBuildReferencesThread_GroupsBySubject(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []threadMsgInfo{
+		{SeqNum: 1, MsgID: "a", Subject: "Party", Date: base},
+		{SeqNum: 2, MsgID: "b", Subject: "Re: Party", Date: base.Add(time.Hour)},
+	}
+
+	thread := buildReferencesThread(msgs)
+	if len(thread.Children) != 1 {
+		t.Fatalf("expected subject grouping to merge unrelated messages with the same subject, got %d roots", len(thread.Children))
+	}
+}
+
+func TestBuildReferencesThread_NoCycle(t *testing.T) {
+	// "a" references "b" and vice versa - addChild must refuse to create a
+	// cycle instead of looping forever.
+	msgs := []threadMsgInfo{
+		{SeqNum: 1, MsgID: "a", References: []string{"b"}},
+		{SeqNum: 2, MsgID: "b", References: []string{"a"}},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		buildReferencesThread(msgs)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("buildReferencesThread did not return - likely an infinite loop from a reference cycle")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/lib/pq"
+)
+
+// pgNotifyLimit is Postgres' hard cap on the payload of a single NOTIFY
+// message (8000 bytes, we leave a margin for the envelope).
+const pgNotifyLimit = 7800
+
+// PgListenPipe implements P using Postgres LISTEN/NOTIFY so multiple maddy
+// instances sharing the same Postgres-backed imapsql storage can replicate
+// backend.Update events without a shared filesystem for a Unix socket.
+type PgListenPipe struct {
+	// DSN is the data source used to open the dedicated connection used for
+	// LISTEN (pq.Listener keeps its own connection separate from the pool
+	// used for queries).
+	DSN string
+	// Channel is the Postgres NOTIFY channel name, normally derived from a
+	// SHA1 hash of the DSN so unrelated maddy deployments sharing a cluster
+	// don't cross-talk.
+	Channel string
+	Log     log.Logger
+
+	listener *pq.Listener
+	notifyDB *sql.DB
+}
+
+type pgUpdateEnvelope struct {
+	// Reload, when set, means the payload didn't fit the NOTIFY size limit
+	// and the receiving side should treat this as "something changed in
+	// this mailbox, re-read it from the DB" instead of trying to decode a
+	// full update.
+	Reload  bool            `json:"reload,omitempty"`
+	Account string          `json:"account,omitempty"`
+	Mailbox string          `json:"mailbox,omitempty"`
+	Update  json.RawMessage `json:"update,omitempty"`
+}
+
+func (p *PgListenPipe) Listen(updPipe chan<- backend.Update) error {
+	p.listener = pq.NewListener(p.DSN, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			p.Log.Error("listener error", err)
+		}
+	})
+	if err := p.listener.Listen(p.Channel); err != nil {
+		return fmt.Errorf("updatepipe: pg listen: %w", err)
+	}
+
+	go func() {
+		for n := range p.listener.Notify {
+			if n == nil {
+				// Connection was lost and reestablished; pq.Listener
+				// resends LISTEN automatically, nothing further to do
+				// besides waiting for the next notification.
+				continue
+			}
+
+			var env pgUpdateEnvelope
+			if err := json.Unmarshal([]byte(n.Extra), &env); err != nil {
+				p.Log.Error("malformed update payload", err)
+				continue
+			}
+
+			if env.Reload {
+				updPipe <- &backend.MailboxInfoUpdate{
+					Update: backend.NewUpdate(env.Account, env.Mailbox),
+				}
+				continue
+			}
+
+			upd, err := unmarshalUpdate(env.Account, env.Mailbox, env.Update)
+			if err != nil {
+				p.Log.Error("malformed update payload", err)
+				continue
+			}
+			updPipe <- upd
+		}
+	}()
+
+	return nil
+}
+
+func (p *PgListenPipe) InitPush() error {
+	db, err := sql.Open("postgres", p.DSN)
+	if err != nil {
+		return fmt.Errorf("updatepipe: pg push init: %w", err)
+	}
+	p.notifyDB = db
+	return nil
+}
+
+func (p *PgListenPipe) Push(u backend.Update) error {
+	payload, err := marshalUpdate(u)
+	env := pgUpdateEnvelope{
+		Account: updateAccount(u),
+		Mailbox: updateMailbox(u),
+		Update:  payload,
+	}
+	if err != nil || len(payload) > pgNotifyLimit {
+		env.Reload = true
+		env.Update = nil
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("updatepipe: pg push: %w", err)
+	}
+
+	if _, err := p.notifyDB.Exec(`SELECT pg_notify($1, $2)`, p.Channel, string(data)); err != nil {
+		return fmt.Errorf("updatepipe: pg push: %w", err)
+	}
+	return nil
+}
+
+func (p *PgListenPipe) Close() error {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.notifyDB != nil {
+		p.notifyDB.Close()
+	}
+	return nil
+}
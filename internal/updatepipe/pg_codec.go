@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// updateKind tags which concrete backend.Update type a JSON payload decodes
+// into, since backend.Update itself carries no such discriminator.
+type updateKind string
+
+const (
+	kindMailbox     updateKind = "mailbox"
+	kindMessage     updateKind = "message"
+	kindExpunge     updateKind = "expunge"
+	kindMailboxInfo updateKind = "mailbox_info"
+)
+
+type pgUpdatePayload struct {
+	Kind          updateKind          `json:"kind"`
+	MailboxStatus *imap.MailboxStatus `json:"mailbox_status,omitempty"`
+	Message       *imap.Message       `json:"message,omitempty"`
+	SeqNum        uint32              `json:"seq_num,omitempty"`
+	MailboxInfo   *imap.MailboxInfo   `json:"mailbox_info,omitempty"`
+}
+
+func updateAccount(u backend.Update) string {
+	return u.Update().Username
+}
+
+func updateMailbox(u backend.Update) string {
+	return u.Update().Mailbox
+}
+
+func marshalUpdate(u backend.Update) ([]byte, error) {
+	var payload pgUpdatePayload
+	switch upd := u.(type) {
+	case *backend.MailboxUpdate:
+		payload = pgUpdatePayload{Kind: kindMailbox, MailboxStatus: upd.MailboxStatus}
+	case *backend.MessageUpdate:
+		payload = pgUpdatePayload{Kind: kindMessage, Message: upd.Message}
+	case *backend.ExpungeUpdate:
+		payload = pgUpdatePayload{Kind: kindExpunge, SeqNum: upd.SeqNum}
+	case *backend.MailboxInfoUpdate:
+		payload = pgUpdatePayload{Kind: kindMailboxInfo, MailboxInfo: upd.MailboxInfo}
+	default:
+		return nil, fmt.Errorf("updatepipe: unsupported update type %T", u)
+	}
+	return json.Marshal(payload)
+}
+
+func unmarshalUpdate(account, mailbox string, data []byte) (backend.Update, error) {
+	var payload pgUpdatePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+
+	base := backend.NewUpdate(account, mailbox)
+	switch payload.Kind {
+	case kindMailbox:
+		return &backend.MailboxUpdate{Update: base, MailboxStatus: payload.MailboxStatus}, nil
+	case kindMessage:
+		return &backend.MessageUpdate{Update: base, Message: payload.Message}, nil
+	case kindExpunge:
+		return &backend.ExpungeUpdate{Update: base, SeqNum: payload.SeqNum}, nil
+	case kindMailboxInfo:
+		return &backend.MailboxInfoUpdate{Update: base, MailboxInfo: payload.MailboxInfo}, nil
+	default:
+		return nil, fmt.Errorf("updatepipe: unknown update kind %q", payload.Kind)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestMarshalUnmarshalUpdate_Expunge(t *testing.T) {
+	orig := &backend.ExpungeUpdate{
+		Update: backend.NewUpdate("user@example.org", "INBOX"),
+		SeqNum: 42,
+	}
+
+	data, err := marshalUpdate(orig)
+	if err != nil {
+		t.Fatalf("marshalUpdate: %v", err)
+	}
+
+	got, err := unmarshalUpdate(updateAccount(orig), updateMailbox(orig), data)
+	if err != nil {
+		t.Fatalf("unmarshalUpdate: %v", err)
+	}
+
+	expunge, ok := got.(*backend.ExpungeUpdate)
+	if !ok {
+		t.Fatalf("unmarshalUpdate returned %T, want *backend.ExpungeUpdate", got)
+	}
+	if expunge.SeqNum != orig.SeqNum {
+		t.Errorf("SeqNum = %d, want %d", expunge.SeqNum, orig.SeqNum)
+	}
+	if updateAccount(expunge) != "user@example.org" || updateMailbox(expunge) != "INBOX" {
+		t.Errorf("account/mailbox not preserved: got %q/%q", updateAccount(expunge), updateMailbox(expunge))
+	}
+}
+
+func TestMarshalUnmarshalUpdate_Message(t *testing.T) {
+	orig := &backend.MessageUpdate{
+		Update:  backend.NewUpdate("user@example.org", "INBOX"),
+		Message: &imap.Message{SeqNum: 7, Uid: 100},
+	}
+
+	data, err := marshalUpdate(orig)
+	if err != nil {
+		t.Fatalf("marshalUpdate: %v", err)
+	}
+
+	got, err := unmarshalUpdate(updateAccount(orig), updateMailbox(orig), data)
+	if err != nil {
+		t.Fatalf("unmarshalUpdate: %v", err)
+	}
+
+	msgUpd, ok := got.(*backend.MessageUpdate)
+	if !ok {
+		t.Fatalf("unmarshalUpdate returned %T, want *backend.MessageUpdate", got)
+	}
+	if msgUpd.Message == nil || msgUpd.Message.Uid != 100 {
+		t.Errorf("Message.Uid not preserved, got %+v", msgUpd.Message)
+	}
+}
+
+func TestMarshalUpdate_UnsupportedType(t *testing.T) {
+	if _, err := marshalUpdate(nil); err == nil {
+		t.Fatal("expected an error for an unsupported update type, got nil")
+	}
+}